@@ -0,0 +1,377 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package netlinkutil talks to the kernel routing tables on behalf of the
+// rest of Raven.
+package netlinkutil
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Rule, Route, Neigh and Addr are backend-agnostic: Backend's list and
+// mutation methods are implemented purely in terms of these, not
+// vishvananda/netlink's own types. The exception is Txn, returned by
+// Backend.NewTxn, whose methods take vishvananda/netlink's types directly.
+
+type Rule struct {
+	Priority          int
+	Family            int
+	Table             int
+	Src               *net.IPNet
+	FwMark            int
+	FwMask            int
+	IifName           string
+	OifName           string
+	Invert            bool
+	SuppressPrefixlen int
+	SuppressIfgroup   int
+}
+
+type Route struct {
+	Family    int
+	Table     int
+	LinkIndex int
+	Dst       *net.IPNet
+	Src       net.IP
+	Gw        net.IP
+}
+
+type Neigh struct {
+	LinkIndex    int
+	Family       int
+	State        int
+	Flags        int
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+}
+
+type Addr struct {
+	LinkIndex int
+	IPNet     *net.IPNet
+	Label     string
+	Scope     int
+	Flags     int
+}
+
+// Backend is the set of netlink operations the reconciler relies on.
+type Backend interface {
+	RuleAdd(rule *Rule) error
+	RuleDel(rule *Rule) error
+	RuleList(family, table int) ([]*Rule, error)
+
+	RouteAdd(route *Route) error
+	RouteDel(route *Route) error
+	RouteReplace(route *Route) error
+	RouteList(family, table int) ([]*Route, error)
+
+	NeighList(linkIndex, family int) ([]*Neigh, error)
+	NeighAppend(neigh *Neigh) error
+	NeighDel(neigh *Neigh) error
+
+	AddrList(linkIndex, family int) ([]*Addr, error)
+	AddrAdd(addr *Addr) error
+	AddrDel(addr *Addr) error
+
+	// NewTxn opens a session that every mutation in one reconcile pass can
+	// share, instead of each mutation paying for its own socket open and
+	// close. It does not make the mutations run in a single kernel
+	// transaction: each is still a separate, individually-acked netlink
+	// message, applied in the order the caller issues them.
+	NewTxn() (Txn, error)
+}
+
+// Txn is a Backend session for a batch of rule/route/neigh mutations.
+type Txn interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	NeighAppend(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+	Close()
+}
+
+// NewTxn opens a Txn on the current Backend.
+func NewTxn() (Txn, error) { return backend.NewTxn() }
+
+// backend is the Backend used by the package-level functions below.
+var backend Backend = vishvanandaBackend{}
+
+// SetBackend replaces the Backend used by the package-level functions.
+// Not safe to call concurrently with them; set it once during startup.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+type vishvanandaBackend struct{}
+
+func (vishvanandaBackend) RuleAdd(rule *Rule) error { return netlink.RuleAdd(toNlRule(rule)) }
+func (vishvanandaBackend) RuleDel(rule *Rule) error { return netlink.RuleDel(toNlRule(rule)) }
+func (vishvanandaBackend) RuleList(family, table int) ([]*Rule, error) {
+	rules, err := netlink.RuleListFiltered(family, &netlink.Rule{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Rule, len(rules))
+	for i := range rules {
+		out[i] = fromNlRule(&rules[i])
+	}
+	return out, nil
+}
+
+func (vishvanandaBackend) RouteAdd(route *Route) error { return netlink.RouteAdd(toNlRoute(route)) }
+func (vishvanandaBackend) RouteDel(route *Route) error { return netlink.RouteDel(toNlRoute(route)) }
+func (vishvanandaBackend) RouteReplace(route *Route) error {
+	return netlink.RouteReplace(toNlRoute(route))
+}
+func (vishvanandaBackend) RouteList(family, table int) ([]*Route, error) {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Route, len(routes))
+	for i := range routes {
+		out[i] = fromNlRoute(&routes[i])
+	}
+	return out, nil
+}
+
+func (vishvanandaBackend) NeighList(linkIndex, family int) ([]*Neigh, error) {
+	neighs, err := netlink.NeighList(linkIndex, family)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Neigh, len(neighs))
+	for i := range neighs {
+		out[i] = fromNlNeigh(&neighs[i])
+	}
+	return out, nil
+}
+func (vishvanandaBackend) NeighAppend(neigh *Neigh) error {
+	return netlink.NeighAppend(toNlNeigh(neigh))
+}
+func (vishvanandaBackend) NeighDel(neigh *Neigh) error { return netlink.NeighDel(toNlNeigh(neigh)) }
+
+func (vishvanandaBackend) AddrList(linkIndex, family int) ([]*Addr, error) {
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Addr, len(addrs))
+	for i := range addrs {
+		out[i] = fromNlAddr(linkIndex, &addrs[i])
+	}
+	return out, nil
+}
+func (vishvanandaBackend) AddrAdd(addr *Addr) error {
+	link, err := netlink.LinkByIndex(addr.LinkIndex)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrAdd(link, toNlAddr(addr))
+}
+func (vishvanandaBackend) AddrDel(addr *Addr) error {
+	link, err := netlink.LinkByIndex(addr.LinkIndex)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrDel(link, toNlAddr(addr))
+}
+
+func (vishvanandaBackend) NewTxn() (Txn, error) {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return nil, err
+	}
+	return &vishvanandaTxn{handle: h}, nil
+}
+
+// vishvanandaTxn runs every op on the one netlink.Handle it was opened
+// with, instead of each op opening and closing its own socket.
+type vishvanandaTxn struct {
+	handle *netlink.Handle
+}
+
+func (t *vishvanandaTxn) RuleAdd(rule *netlink.Rule) error    { return t.handle.RuleAdd(rule) }
+func (t *vishvanandaTxn) RuleDel(rule *netlink.Rule) error    { return t.handle.RuleDel(rule) }
+func (t *vishvanandaTxn) RouteAdd(route *netlink.Route) error { return t.handle.RouteAdd(route) }
+func (t *vishvanandaTxn) RouteDel(route *netlink.Route) error { return t.handle.RouteDel(route) }
+func (t *vishvanandaTxn) RouteReplace(route *netlink.Route) error {
+	return t.handle.RouteReplace(route)
+}
+func (t *vishvanandaTxn) NeighAppend(neigh *netlink.Neigh) error { return t.handle.NeighAppend(neigh) }
+func (t *vishvanandaTxn) NeighDel(neigh *netlink.Neigh) error    { return t.handle.NeighDel(neigh) }
+func (t *vishvanandaTxn) Close()                                 { t.handle.Close() }
+
+func fromNlRule(r *netlink.Rule) *Rule {
+	return &Rule{
+		Priority:          r.Priority,
+		Family:            r.Family,
+		Table:             r.Table,
+		Src:               r.Src,
+		FwMark:            r.Mark,
+		FwMask:            r.Mask,
+		IifName:           r.IifName,
+		OifName:           r.OifName,
+		Invert:            r.Invert,
+		SuppressPrefixlen: r.SuppressPrefixlen,
+		SuppressIfgroup:   r.SuppressIfgroup,
+	}
+}
+
+func toNlRule(r *Rule) *netlink.Rule {
+	nr := netlink.NewRule()
+	nr.Priority = r.Priority
+	nr.Family = r.Family
+	nr.Table = r.Table
+	nr.Src = r.Src
+	nr.Mark = r.FwMark
+	nr.Mask = r.FwMask
+	nr.IifName = r.IifName
+	nr.OifName = r.OifName
+	nr.Invert = r.Invert
+	nr.SuppressPrefixlen = r.SuppressPrefixlen
+	nr.SuppressIfgroup = r.SuppressIfgroup
+	return nr
+}
+
+func fromNlRoute(r *netlink.Route) *Route {
+	return &Route{Family: r.Family, Table: r.Table, LinkIndex: r.LinkIndex, Dst: r.Dst, Src: r.Src, Gw: r.Gw}
+}
+
+func toNlRoute(r *Route) *netlink.Route {
+	return &netlink.Route{Family: r.Family, Table: r.Table, LinkIndex: r.LinkIndex, Dst: r.Dst, Src: r.Src, Gw: r.Gw}
+}
+
+func fromNlNeigh(n *netlink.Neigh) *Neigh {
+	return &Neigh{
+		LinkIndex:    n.LinkIndex,
+		Family:       n.Family,
+		State:        n.State,
+		Flags:        n.Flags,
+		IP:           n.IP,
+		HardwareAddr: n.HardwareAddr,
+	}
+}
+
+func toNlNeigh(n *Neigh) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    n.LinkIndex,
+		Family:       n.Family,
+		State:        n.State,
+		Flags:        n.Flags,
+		IP:           n.IP,
+		HardwareAddr: n.HardwareAddr,
+	}
+}
+
+func fromNlAddr(linkIndex int, a *netlink.Addr) *Addr {
+	return &Addr{LinkIndex: linkIndex, IPNet: a.IPNet, Label: a.Label, Scope: a.Scope, Flags: a.Flags}
+}
+
+func toNlAddr(a *Addr) *netlink.Addr {
+	return &netlink.Addr{IPNet: a.IPNet, Label: a.Label, Scope: a.Scope, Flags: a.Flags}
+}
+
+func RuleAdd(rule *netlink.Rule) error { return backend.RuleAdd(fromNlRule(rule)) }
+func RuleDel(rule *netlink.Rule) error { return backend.RuleDel(fromNlRule(rule)) }
+func RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error) {
+	rules, err := backend.RuleList(family, filter.Table)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]netlink.Rule, len(rules))
+	for i, r := range rules {
+		out[i] = *toNlRule(r)
+	}
+	return out, nil
+}
+
+func RouteAdd(route *netlink.Route) error     { return backend.RouteAdd(fromNlRoute(route)) }
+func RouteDel(route *netlink.Route) error     { return backend.RouteDel(fromNlRoute(route)) }
+func RouteReplace(route *netlink.Route) error { return backend.RouteReplace(fromNlRoute(route)) }
+func RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	routes, err := backend.RouteList(family, filter.Table)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]netlink.Route, len(routes))
+	for i, r := range routes {
+		out[i] = *toNlRoute(r)
+	}
+	return out, nil
+}
+
+func NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	neighs, err := backend.NeighList(linkIndex, family)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]netlink.Neigh, len(neighs))
+	for i, n := range neighs {
+		out[i] = *toNlNeigh(n)
+	}
+	return out, nil
+}
+func NeighAppend(neigh *netlink.Neigh) error { return backend.NeighAppend(fromNlNeigh(neigh)) }
+func NeighDel(neigh *netlink.Neigh) error    { return backend.NeighDel(fromNlNeigh(neigh)) }
+
+func AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	addrs, err := backend.AddrList(link.Attrs().Index, family)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]netlink.Addr, len(addrs))
+	for i, a := range addrs {
+		out[i] = *toNlAddr(a)
+	}
+	return out, nil
+}
+func AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return backend.AddrAdd(fromNlAddr(link.Attrs().Index, addr))
+}
+func AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return backend.AddrDel(fromNlAddr(link.Attrs().Index, addr))
+}
+
+// RouteSubscribeWithOptions, RuleSubscribe and NeighSubscribe stream
+// kernel updates rather than returning a snapshot, so they're kept as
+// direct calls into github.com/vishvananda/netlink instead of going
+// through Backend: a subscription is a long-lived socket, not a request/
+// response the strict-matching backends Backend exists for would change.
+
+func RouteSubscribeWithOptions(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribeWithOptions(ch, done, netlink.RouteSubscribeOptions{})
+}
+
+func RuleSubscribe(ch chan<- netlink.RuleUpdate, done <-chan struct{}) error {
+	return netlink.RuleSubscribe(ch, done)
+}
+
+func NeighSubscribe(ch chan<- netlink.NeighUpdate, done <-chan struct{}) error {
+	return netlink.NeighSubscribe(ch, done)
+}
@@ -20,7 +20,6 @@
 package networkutil
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 	"syscall"
@@ -36,31 +35,72 @@ var (
 	AllZeroMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
 )
 
-func NewRavenRule(rulePriority int, routeTableID int) *netlink.Rule {
+type RuleSpec struct {
+	Priority int
+	Table    int
+	Family   int
+	FwMark   int
+	FwMask   int
+	IifName  string
+	OifName  string
+	Invert   bool
+	// SuppressPrefixlen and SuppressIfgroup are pointers because 0 is a
+	// valid value for each, distinct from unset.
+	SuppressPrefixlen *int
+	SuppressIfgroup   *int
+}
+
+func NewRavenRule(spec RuleSpec) *netlink.Rule {
 	rule := netlink.NewRule()
-	rule.Priority = rulePriority
-	rule.Table = routeTableID
-	rule.Family = netlink.FAMILY_V4
+	rule.Priority = spec.Priority
+	rule.Table = spec.Table
+	rule.Family = spec.Family
+	rule.Mark = spec.FwMark
+	rule.Mask = spec.FwMask
+	rule.IifName = spec.IifName
+	rule.OifName = spec.OifName
+	rule.Invert = spec.Invert
+	rule.SuppressPrefixlen = -1
+	if spec.SuppressPrefixlen != nil {
+		rule.SuppressPrefixlen = *spec.SuppressPrefixlen
+	}
+	rule.SuppressIfgroup = -1
+	if spec.SuppressIfgroup != nil {
+		rule.SuppressIfgroup = *spec.SuppressIfgroup
+	}
 	return rule
 }
 
 func RouteKey(route *netlink.Route) string {
-	return fmt.Sprintf("%s-%d", route.Dst, route.Table)
+	dst := defaultDstForFamily(route.Family)
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	return fmt.Sprintf("%d-%s-%d", route.Family, dst, route.Table)
 }
 
 func RuleKey(rule *netlink.Rule) string {
-	src := "0.0.0.0/0"
+	src := defaultDstForFamily(rule.Family)
 	srcIPNet := rule.Src
 	if srcIPNet != nil {
 		src = srcIPNet.String()
 	}
-	return src
+	return fmt.Sprintf("%d-%s-mark=%d/%d-iif=%s-oif=%s-invert=%t-suppress=%d-sifgroup=%d",
+		rule.Family, src, rule.Mark, rule.Mask, rule.IifName, rule.OifName,
+		rule.Invert, rule.SuppressPrefixlen, rule.SuppressIfgroup)
+}
+
+func defaultDstForFamily(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
 }
 
 func ListRulesOnNode(routeTableID int) (map[string]*netlink.Rule, error) {
 	rulesOnNode := make(map[string]*netlink.Rule)
 
-	rules, err := netlinkutil.RuleListFiltered(netlink.FAMILY_V4,
+	rules, err := netlinkutil.RuleListFiltered(netlink.FAMILY_ALL,
 		&netlink.Rule{Table: routeTableID},
 		netlink.RT_FILTER_TABLE)
 	if err != nil {
@@ -76,7 +116,7 @@ func ListRulesOnNode(routeTableID int) (map[string]*netlink.Rule, error) {
 
 func ListRoutesOnNode(routeTableID int) (map[string]*netlink.Route, error) {
 	routes, err := netlinkutil.RouteListFiltered(
-		netlink.FAMILY_V4,
+		netlink.FAMILY_ALL,
 		&netlink.Route{Table: routeTableID},
 		netlink.RT_FILTER_TABLE)
 	if err != nil {
@@ -89,57 +129,154 @@ func ListRoutesOnNode(routeTableID int) (map[string]*netlink.Route, error) {
 	return ro, nil
 }
 
-func ApplyRules(current, desired map[string]*netlink.Rule) (err error) {
+// txnOp is one netlink mutation applied as part of a sequence, paired
+// with the rollback that undoes it and restores the previous current
+// state. apply/rollback run on the txn shared by the whole sequence, so
+// a reconcile pass touching hundreds of rules/routes/FDB entries opens
+// one netlink socket instead of one per mutation. logMsg/logKV are
+// logged exactly as the individual add/delete calls were before ops were
+// introduced, so existing log-field queries (e.g. on "src" or "lookup")
+// keep working.
+type txnOp struct {
+	desc     string
+	logMsg   string
+	logKV    []interface{}
+	apply    func(txn netlinkutil.Txn) error
+	rollback func(txn netlinkutil.Txn) error
+}
+
+// InconsistentStateError means an op in a runTxn sequence failed and,
+// while unwinding, a rollback of an already-applied op also failed. The
+// node is now in neither the old nor the new desired state, so the
+// caller should force a full resync (re-list current and reapply) on
+// its next pass rather than trust the existing current/desired diff.
+type InconsistentStateError struct {
+	err error
+}
+
+func (e *InconsistentStateError) Error() string { return e.err.Error() }
+func (e *InconsistentStateError) Unwrap() error { return e.err }
+
+// runTxn applies ops in order over a single netlinkutil.Txn, so a reconcile
+// pass touching hundreds of rules/routes/FDB entries pays for one socket
+// open instead of one per mutation. It is not a single atomic kernel
+// operation: netlink gives rule/route/neigh objects no such primitive, so
+// each op is still a separate, individually-acked message, and the kernel
+// can be observed mid-pass. If an op fails, every op already applied
+// earlier in this call is rolled back, in reverse order, before the
+// failure is returned, so a reconcile pass never leaves the node
+// half-converged on its own terms; if undoing an already-applied op
+// itself fails, the result is an InconsistentStateError rather than a
+// plain one, so callers can tell "rolled back cleanly" apart from "state
+// is now unknown, resync from scratch."
+func runTxn(ops []txnOp) error {
+	txn, err := netlinkutil.NewTxn()
+	if err != nil {
+		return fmt.Errorf("open netlink txn: %w", err)
+	}
+	defer txn.Close()
+
+	errList := errorlist.List{}
+	for i, op := range ops {
+		if len(op.logKV) > 0 {
+			klog.InfoS(op.logMsg, op.logKV...)
+		} else {
+			klog.InfoS(op.logMsg)
+		}
+		if err := op.apply(txn); err != nil {
+			errList = errList.Append(fmt.Errorf("%s: %s", op.desc, err))
+			rollbackFailed := false
+			for j := i - 1; j >= 0; j-- {
+				if rerr := ops[j].rollback(txn); rerr != nil {
+					errList = errList.Append(fmt.Errorf("rollback %s: %s", ops[j].desc, rerr))
+					rollbackFailed = true
+				}
+			}
+			if rollbackFailed {
+				return &InconsistentStateError{err: errList.AsError()}
+			}
+			return errList.AsError()
+		}
+	}
+	return errList.AsError()
+}
+
+func ApplyRules(current, desired map[string]*netlink.Rule) error {
 	if klog.V(5).Enabled() {
 		klog.InfoS("applying rules", "current", current, "desired", desired)
 	}
-	errList := errorlist.List{}
+	var ops []txnOp
 	for k, v := range desired {
+		v := v
 		_, ok := current[k]
 		if !ok {
-			klog.InfoS("adding rule", "src", v.Src, "lookup", v.Table)
-			err = netlinkutil.RuleAdd(v)
-			errList = errList.Append(err)
+			ops = append(ops, txnOp{
+				desc:     fmt.Sprintf("adding rule src=%s lookup=%d", v.Src, v.Table),
+				logMsg:   "adding rule",
+				logKV:    []interface{}{"src", v.Src, "lookup", v.Table},
+				apply:    func(txn netlinkutil.Txn) error { return txn.RuleAdd(v) },
+				rollback: func(txn netlinkutil.Txn) error { return txn.RuleDel(v) },
+			})
 			continue
 		}
 		delete(current, k)
 	}
 	// remove unwanted rules
 	for _, v := range current {
-		klog.InfoS("deleting rule", "src", v.Src, "lookup", v.Table)
-		err = netlinkutil.RuleDel(v)
-		errList = errList.Append(err)
+		v := v
+		ops = append(ops, txnOp{
+			desc:     fmt.Sprintf("deleting rule src=%s lookup=%d", v.Src, v.Table),
+			logMsg:   "deleting rule",
+			logKV:    []interface{}{"src", v.Src, "lookup", v.Table},
+			apply:    func(txn netlinkutil.Txn) error { return txn.RuleDel(v) },
+			rollback: func(txn netlinkutil.Txn) error { return txn.RuleAdd(v) },
+		})
 	}
-	return errList.AsError()
+	return runTxn(ops)
 }
 
-func ApplyRoutes(current, desired map[string]*netlink.Route) (err error) {
+func ApplyRoutes(current, desired map[string]*netlink.Route) error {
 	if klog.V(5).Enabled() {
 		klog.InfoS("applying routes", "current", current, "desired", desired)
 	}
-	errList := errorlist.List{}
+	var ops []txnOp
 	for k, v := range desired {
+		v := v
 		ro, ok := current[k]
 		if !ok {
-			klog.InfoS("adding route", "dst", v.Dst, "via", v.Gw, "src", v.Src, "table", v.Table)
-			err = netlinkutil.RouteAdd(v)
-			errList = errList.Append(err)
+			ops = append(ops, txnOp{
+				desc:     fmt.Sprintf("adding route dst=%s via=%s src=%s table=%d", v.Dst, v.Gw, v.Src, v.Table),
+				logMsg:   "adding route",
+				logKV:    []interface{}{"dst", v.Dst, "via", v.Gw, "src", v.Src, "table", v.Table},
+				apply:    func(txn netlinkutil.Txn) error { return txn.RouteAdd(v) },
+				rollback: func(txn netlinkutil.Txn) error { return txn.RouteDel(v) },
+			})
 			continue
 		}
 		delete(current, k)
 		if !routeEqual(*ro, *v) {
-			klog.InfoS("replacing route", "dst", v.Dst, "via", v.Gw, "src", v.Src, "table", v.Table)
-			err = netlinkutil.RouteReplace(v)
-			errList = errList.Append(err)
+			ro := ro
+			ops = append(ops, txnOp{
+				desc:     fmt.Sprintf("replacing route dst=%s via=%s src=%s table=%d", v.Dst, v.Gw, v.Src, v.Table),
+				logMsg:   "replacing route",
+				logKV:    []interface{}{"dst", v.Dst, "via", v.Gw, "src", v.Src, "table", v.Table},
+				apply:    func(txn netlinkutil.Txn) error { return txn.RouteReplace(v) },
+				rollback: func(txn netlinkutil.Txn) error { return txn.RouteReplace(ro) },
+			})
 		}
 	}
 	// remove unwanted routes
 	for _, v := range current {
-		klog.InfoS("deleting route", "dst", v.Dst.String(), "via", v.Gw.String())
-		err = netlinkutil.RouteDel(v)
-		errList = errList.Append(err)
+		v := v
+		ops = append(ops, txnOp{
+			desc:     fmt.Sprintf("deleting route dst=%s via=%s", v.Dst, v.Gw),
+			logMsg:   "deleting route",
+			logKV:    []interface{}{"dst", v.Dst.String(), "via", v.Gw.String()},
+			apply:    func(txn netlinkutil.Txn) error { return txn.RouteDel(v) },
+			rollback: func(txn netlinkutil.Txn) error { return txn.RouteAdd(v) },
+		})
 	}
-	return errList.AsError()
+	return runTxn(ops)
 }
 
 func ListFDBsOnNode(link netlink.Link) (map[string]*netlink.Neigh, error) {
@@ -156,30 +293,99 @@ func ListFDBsOnNode(link netlink.Link) (map[string]*netlink.Neigh, error) {
 	return fdbsOnNode, nil
 }
 
-func ApplyFDBs(current, desired map[string]*netlink.Neigh) (err error) {
+func ApplyFDBs(current, desired map[string]*netlink.Neigh) error {
 	if klog.V(5).Enabled() {
 		klog.InfoS("applying FDBs", "current", current, "desired", desired)
 	}
+	var ops []txnOp
+	for k, v := range desired {
+		v := v
+		_, ok := current[k]
+		if !ok {
+			ops = append(ops, txnOp{
+				desc:     fmt.Sprintf("adding FDB dst=%s mac=%s", v.IP, v.HardwareAddr),
+				logMsg:   "adding FDB",
+				logKV:    []interface{}{"dst", v.IP, "mac", v.HardwareAddr},
+				apply:    func(txn netlinkutil.Txn) error { return txn.NeighAppend(v) },
+				rollback: func(txn netlinkutil.Txn) error { return txn.NeighDel(v) },
+			})
+			continue
+		}
+		delete(current, k)
+	}
+	// remove unwanted fdb entries
+	for _, v := range current {
+		v := v
+		ops = append(ops, txnOp{
+			desc:     fmt.Sprintf("deleting FDB dst=%s mac=%s", v.IP, v.HardwareAddr),
+			logMsg:   "deleting FDB",
+			logKV:    []interface{}{"dst", v.IP, "mac", v.HardwareAddr},
+			apply:    func(txn netlinkutil.Txn) error { return txn.NeighDel(v) },
+			rollback: func(txn netlinkutil.Txn) error { return txn.NeighAppend(v) },
+		})
+	}
+	return runTxn(ops)
+}
+
+// ListAddrsOnLink skips link-scoped addresses (e.g. the kernel-autoassigned
+// IPv6 link-local address): Raven doesn't add them and must not reconcile
+// them away.
+func ListAddrsOnLink(link netlink.Link) (map[string]*netlink.Addr, error) {
+	addrs, err := netlinkutil.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	addrsOnLink := make(map[string]*netlink.Addr)
+	for k, v := range addrs {
+		if v.Scope == int(netlink.SCOPE_LINK) {
+			continue
+		}
+		addrsOnLink[v.IPNet.String()] = &addrs[k]
+	}
+	return addrsOnLink, nil
+}
+
+// ApplyAddrs expects current to come from ListAddrsOnLink, so link-scoped
+// addresses are never reconciled away.
+func ApplyAddrs(link netlink.Link, current, desired map[string]*netlink.Addr) (err error) {
+	if klog.V(5).Enabled() {
+		klog.InfoS("applying addrs", "link", link.Attrs().Name, "current", current, "desired", desired)
+	}
 	errList := errorlist.List{}
 	for k, v := range desired {
 		_, ok := current[k]
 		if !ok {
-			klog.InfoS("adding FDB", "dst", v.IP, "mac", v.HardwareAddr)
-			err = netlinkutil.NeighAppend(v)
+			klog.InfoS("adding addr", "link", link.Attrs().Name, "addr", v.IPNet)
+			err = netlinkutil.AddrAdd(link, v)
 			errList = errList.Append(err)
 			continue
 		}
 		delete(current, k)
 	}
-	// remove unwanted fdb entries
+	// remove addresses that are no longer desired
 	for _, v := range current {
-		klog.InfoS("deleting FDB", "dst", v.IP, "mac", v.HardwareAddr)
-		err = netlinkutil.NeighDel(v)
+		klog.InfoS("deleting addr", "link", link.Attrs().Name, "addr", v.IPNet)
+		err = netlinkutil.AddrDel(link, v)
 		errList = errList.Append(err)
 	}
 	return errList.AsError()
 }
 
+func CleanAddrsOnLink(link netlink.Link) error {
+	errList := errorlist.List{}
+	addrs, err := ListAddrsOnLink(link)
+	if err != nil {
+		errList = errList.Append(fmt.Errorf("error listing addrs: %s", err))
+	}
+	for _, v := range addrs {
+		err = netlinkutil.AddrDel(link, v)
+		if err != nil {
+			errList = errList.Append(fmt.Errorf("error deleting addrs: %s", err))
+		}
+	}
+	return errList.AsError()
+}
+
 func CleanRoutesOnNode(routeTableID int) error {
 	errList := errorlist.List{}
 	routes, err := ListRoutesOnNode(routeTableID)
@@ -210,11 +416,29 @@ func CleanRulesOnNode(routeTableID int) error {
 	return errList.AsError()
 }
 
+// routeEqual compares Dst/Gw defensively: both may legitimately be nil.
 func routeEqual(x, y netlink.Route) bool {
-	if x.Dst.IP.Equal(y.Dst.IP) && x.Gw.Equal(y.Gw) &&
-		bytes.Equal(x.Dst.Mask, y.Dst.Mask) &&
-		x.LinkIndex == y.LinkIndex {
-		return true
+	if !ipNetEqual(x.Dst, y.Dst) {
+		return false
+	}
+	if !ipEqual(x.Gw, y.Gw) {
+		return false
+	}
+	return x.LinkIndex == y.LinkIndex
+}
+
+func ipEqual(x, y net.IP) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	return x.Equal(y)
+}
+
+func ipNetEqual(x, y *net.IPNet) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
 	}
-	return false
+	xOnes, xBits := x.Mask.Size()
+	yOnes, yBits := y.Mask.Size()
+	return x.IP.Equal(y.IP) && xOnes == yOnes && xBits == yBits
 }
@@ -0,0 +1,190 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package networkutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
+)
+
+// debounceWindow is how long Watch waits after the latest kernel update
+// for an object before emitting an Event for it. Each further update for
+// the same object within the window restarts the wait, so a bulk change
+// (e.g. another process reprogramming many routes at once) produces one
+// reconcile trigger instead of a storm; an object that keeps changing
+// more often than once per window is not emitted until it settles.
+const debounceWindow = 200 * time.Millisecond
+
+// Kind identifies what a watched object is.
+type Kind string
+
+const (
+	KindRoute Kind = "route"
+	KindRule  Kind = "rule"
+	KindFDB   Kind = "fdb"
+)
+
+// Event reports that a route, rule or FDB entry Raven cares about changed
+// in the kernel, outside of Raven's own reconcile loop.
+type Event struct {
+	Kind Kind
+	// Type is the RTM_NEW*/RTM_DEL* message type of the triggering update.
+	Type uint16
+	// Key is the RouteKey/RuleKey/FDB IP of the changed object.
+	Key string
+}
+
+// Watch streams Event notifications for changes to routes and rules in
+// routeTableID and FDB entries on vxlanLinkIndex, so the caller can
+// reconcile as soon as something other than Raven's own sync loop mutates
+// them, instead of waiting for the next periodic sync. The returned
+// channel is closed once ctx is done, or as soon as any of the route,
+// rule or neigh subscription channels is closed.
+func Watch(ctx context.Context, routeTableID, vxlanLinkIndex int) <-chan Event {
+	out := make(chan Event)
+	d := newDebouncer()
+
+	routeCh := make(chan netlink.RouteUpdate)
+	ruleCh := make(chan netlink.RuleUpdate)
+	neighCh := make(chan netlink.NeighUpdate)
+	done := make(chan struct{})
+
+	if err := netlinkutil.RouteSubscribeWithOptions(routeCh, done); err != nil {
+		klog.ErrorS(err, "failed to subscribe to route updates")
+	}
+	if err := netlinkutil.RuleSubscribe(ruleCh, done); err != nil {
+		klog.ErrorS(err, "failed to subscribe to rule updates")
+	}
+	if err := netlinkutil.NeighSubscribe(neighCh, done); err != nil {
+		klog.ErrorS(err, "failed to subscribe to neigh updates")
+	}
+
+	go func() {
+		defer close(out)
+		defer close(done)
+		defer d.stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case key := <-d.ready:
+				if e, ok := d.pop(key); ok {
+					select {
+					case out <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			case u, ok := <-routeCh:
+				if !ok {
+					return
+				}
+				if u.Route.Table != routeTableID {
+					continue
+				}
+				d.add(Event{Kind: KindRoute, Type: u.Type, Key: RouteKey(&u.Route)})
+			case u, ok := <-ruleCh:
+				if !ok {
+					return
+				}
+				if u.Rule.Table != routeTableID {
+					continue
+				}
+				d.add(Event{Kind: KindRule, Type: u.Type, Key: RuleKey(&u.Rule)})
+			case u, ok := <-neighCh:
+				if !ok {
+					return
+				}
+				if u.Neigh.LinkIndex != vxlanLinkIndex || u.Neigh.HardwareAddr.String() != AllZeroMAC.String() {
+					continue
+				}
+				d.add(Event{Kind: KindFDB, Type: u.Type, Key: u.Neigh.IP.String()})
+			}
+		}
+	}()
+
+	return out
+}
+
+// debouncer coalesces Events keyed by (Kind, Key): repeated updates for
+// the same object within debounceWindow collapse into the most recent
+// one. Timers only ever signal readiness on ready; the owning goroutine
+// pops and emits the event itself, so it stays the sole sender on out
+// and can close it safely.
+type debouncer struct {
+	mu      sync.Mutex
+	pending map[string]Event
+	timers  map[string]*time.Timer
+	ready   chan string
+	stopCh  chan struct{}
+}
+
+func newDebouncer() *debouncer {
+	return &debouncer{
+		pending: map[string]Event{},
+		timers:  map[string]*time.Timer{},
+		ready:   make(chan string),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (d *debouncer) add(e Event) {
+	key := string(e.Kind) + "-" + e.Key
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[key] = e
+	if t, ok := d.timers[key]; ok {
+		t.Reset(debounceWindow)
+		return
+	}
+	d.timers[key] = time.AfterFunc(debounceWindow, func() {
+		select {
+		case d.ready <- key:
+		case <-d.stopCh:
+		}
+	})
+}
+
+func (d *debouncer) pop(key string) (Event, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.pending[key]
+	if ok {
+		delete(d.pending, key)
+		delete(d.timers, key)
+	}
+	return e, ok
+}
+
+func (d *debouncer) stop() {
+	close(d.stopCh)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, t := range d.timers {
+		t.Stop()
+	}
+}